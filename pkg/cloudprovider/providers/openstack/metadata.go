@@ -26,6 +26,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"k8s.io/kubernetes/pkg/util/mount"
@@ -51,8 +53,51 @@ const (
 
 	// configDriveID is used as an identifier on the metadata search order configuration.
 	configDriveID = "configDrive"
+
+	// networkDataUrlTemplate allows building an OpenStack network_data.json URL.
+	//https://docs.openstack.org/nova/latest/user/metadata.html#openstack-format-metadata
+	networkDataUrlTemplate  = "http://169.254.169.254/openstack/%s/network_data.json"
+	networkDataPathTemplate = "openstack/%s/network_data.json"
+
+	// defaultMetadataSearchOrder is used when the operator hasn't configured
+	// a search order. Config drive is tried first since, unlike the metadata
+	// service, it doesn't depend on the instance's network being up yet; if
+	// no config drive is found, the metadata service is tried next. This
+	// mirrors the default used by afterburn and ignition on OpenStack.
+	defaultMetadataSearchOrder = configDriveID + "," + metadataID
+
+	// Defaults for the metadata service HTTP client. The 169.254.169.254
+	// endpoint is frequently slow to respond or entirely absent during the
+	// first seconds of boot, particularly on neutron-metadata deployments,
+	// so requests are retried with exponential backoff before giving up.
+	defaultMetadataRequestTimeoutSeconds           = 5
+	defaultMetadataRetryMax                        = 3
+	defaultMetadataRetryBackoffInitialMilliseconds = 250
+
+	// metadataApiRootUrl lists the metadata API versions the metadata
+	// service publishes, one per line.
+	metadataApiRootUrl = "http://169.254.169.254/openstack/"
+
+	// metadataApiRootPath is the config-drive equivalent of
+	// metadataApiRootUrl: a directory with one subdirectory per published
+	// version.
+	metadataApiRootPath = "openstack"
 )
 
+// supportedMetadataVersions is our compiled-in preference list, newest
+// first. Version negotiation picks the first entry here that the metadata
+// source actually publishes; "2018-08-27" is preferred because it's the
+// first version to carry the device tags/vlan/vf_trusted/mac fields needed
+// for SR-IOV/Neutron port binding.
+//https://docs.openstack.org/nova/latest/user/metadata.html#openstack-format-metadata
+var supportedMetadataVersions = []string{
+	"2018-08-27",
+	"2017-02-22",
+	"2016-10-06",
+	"2013-10-17",
+	"2012-08-10",
+}
+
 var ErrBadMetadata = errors.New("invalid OpenStack metadata, got empty uuid")
 
 // There are multiple device types. To keep it simple, we're using a single structure
@@ -62,6 +107,13 @@ type DeviceMetadata struct {
 	Bus     string `json:"bus,omitempty"`
 	Serial  string `json:"serial,omitempty"`
 	Address string `json:"address,omitempty"`
+	// Mac, Tags, Vlan and VfTrusted are only populated by metadata versions
+	// "2018-08-27" and newer, and are needed to bind an SR-IOV VF to the
+	// Kubernetes network attachment it corresponds to.
+	Mac       string   `json:"mac,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Vlan      int      `json:"vlan,omitempty"`
+	VfTrusted bool     `json:"vf_trusted,omitempty"`
 	// .. and other fields.
 }
 
@@ -75,6 +127,125 @@ type Metadata struct {
 	// .. and other fields we don't care about.  Expand as necessary.
 }
 
+// Link is a network_data.json link, representing a physical or virtual
+// network interface attached to the instance.
+type Link struct {
+	ID                 string `json:"id"`
+	VifID              string `json:"vif_id,omitempty"`
+	Type               string `json:"type"`
+	Mtu                int    `json:"mtu,omitempty"`
+	EthernetMacAddress string `json:"ethernet_mac_address,omitempty"`
+	// .. and other fields we don't care about.  Expand as necessary.
+}
+
+// Route is a route published for a network_data.json network.
+type Route struct {
+	Network string `json:"network"`
+	Netmask string `json:"netmask"`
+	Gateway string `json:"gateway"`
+}
+
+// Service is a network service (e.g. DNS) published in network_data.json,
+// either globally or scoped to a single network.
+type Service struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// Network is a network_data.json network, bound to a Link by Link field.
+type Network struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Link      string    `json:"link"`
+	NetworkID string    `json:"network_id"`
+	IPAddress string    `json:"ip_address,omitempty"`
+	Netmask   string    `json:"netmask,omitempty"`
+	Routes    []Route   `json:"routes,omitempty"`
+	Services  []Service `json:"services,omitempty"`
+}
+
+// Assumes the "2012-08-10" network_data.json format.
+//https://docs.openstack.org/nova/latest/user/metadata.html#openstack-format-metadata
+type NetworkData struct {
+	Links    []Link    `json:"links,omitempty"`
+	Networks []Network `json:"networks,omitempty"`
+	Services []Service `json:"services,omitempty"`
+}
+
+// MetadataOpts holds the metadata-related knobs read from the cloud
+// provider config file's [Metadata] section. All fields are optional; a
+// zero value falls back to the corresponding default.
+type MetadataOpts struct {
+	// SearchOrder is a comma-separated list of configDriveID and
+	// metadataID controlling where instance metadata is looked up, and in
+	// which order. Defaults to defaultMetadataSearchOrder.
+	SearchOrder string `gcfg:"search-order"`
+	// RequestTimeoutSeconds bounds each individual metadata service HTTP
+	// request. Defaults to defaultMetadataRequestTimeoutSeconds.
+	RequestTimeoutSeconds int `gcfg:"request-timeout-seconds"`
+	// RetryMax is the number of additional attempts made against the
+	// metadata service after the first failed one. Defaults to
+	// defaultMetadataRetryMax.
+	RetryMax int `gcfg:"retry-max"`
+	// RetryBackoffInitialMilliseconds is the delay before the first retry;
+	// it doubles after each subsequent attempt. Defaults to
+	// defaultMetadataRetryBackoffInitialMilliseconds.
+	RetryBackoffInitialMilliseconds int `gcfg:"retry-backoff-initial-ms"`
+	// Version pins the metadata API version to use (e.g. "2012-08-10"),
+	// bypassing negotiation. Useful for air-gapped or regression
+	// environments where the negotiated version shouldn't change out from
+	// under the cluster. Left empty, the newest version the metadata
+	// source publishes from supportedMetadataVersions is used.
+	Version string `gcfg:"version"`
+}
+
+func (o MetadataOpts) searchOrder() string {
+	if o.SearchOrder == "" {
+		return defaultMetadataSearchOrder
+	}
+	return o.SearchOrder
+}
+
+func (o MetadataOpts) requestTimeout() time.Duration {
+	if o.RequestTimeoutSeconds <= 0 {
+		return defaultMetadataRequestTimeoutSeconds * time.Second
+	}
+	return time.Duration(o.RequestTimeoutSeconds) * time.Second
+}
+
+func (o MetadataOpts) retryMax() int {
+	if o.RetryMax <= 0 {
+		return defaultMetadataRetryMax
+	}
+	return o.RetryMax
+}
+
+func (o MetadataOpts) retryBackoffInitial() time.Duration {
+	if o.RetryBackoffInitialMilliseconds <= 0 {
+		return defaultMetadataRetryBackoffInitialMilliseconds * time.Millisecond
+	}
+	return time.Duration(o.RetryBackoffInitialMilliseconds) * time.Millisecond
+}
+
+// transientMetadataError marks a metadata source as unreachable rather than
+// invalid: the device wasn't found, the drive couldn't be mounted, or the
+// metadata service couldn't be reached (or kept 5xx-ing) after retries.
+// getMetadata/getNetworkData fall through to the next source in the search
+// order on a transientMetadataError, but surface any other error (such as a
+// malformed meta_data.json) immediately rather than masking it.
+type transientMetadataError struct {
+	err error
+}
+
+func (e *transientMetadataError) Error() string {
+	return e.err.Error()
+}
+
+func isTransientMetadataError(err error) bool {
+	_, ok := err.(*transientMetadataError)
+	return ok
+}
+
 // parseMetadata reads JSON from OpenStack metadata server and parses
 // instance ID out of it.
 func parseMetadata(r io.Reader) (*Metadata, error) {
@@ -91,6 +262,15 @@ func parseMetadata(r io.Reader) (*Metadata, error) {
 	return &metadata, nil
 }
 
+// parseNetworkData reads JSON from an OpenStack network_data.json source.
+func parseNetworkData(r io.Reader) (*NetworkData, error) {
+	var networkData NetworkData
+	if err := json.NewDecoder(r).Decode(&networkData); err != nil {
+		return nil, err
+	}
+	return &networkData, nil
+}
+
 func getMetadataUrl(metadataVersion string) string {
 	return fmt.Sprintf(metadataUrlTemplate, metadataVersion)
 }
@@ -99,26 +279,158 @@ func getConfigDrivePath(metadataVersion string) string {
 	return fmt.Sprintf(configDrivePathTemplate, metadataVersion)
 }
 
-func getMetadataFromConfigDrive(metadataVersion string) (*Metadata, error) {
-	// Try to read instance UUID from config drive.
-	dev := "/dev/disk/by-label/" + configDriveLabel
-	if _, err := os.Stat(dev); os.IsNotExist(err) {
+func getNetworkDataUrl(metadataVersion string) string {
+	return fmt.Sprintf(networkDataUrlTemplate, metadataVersion)
+}
+
+func getNetworkDataPath(metadataVersion string) string {
+	return fmt.Sprintf(networkDataPathTemplate, metadataVersion)
+}
+
+// configDriveLabels are the label spellings that nova may write to the
+// config-drive filesystem. Both are documented by OpenStack, and some
+// images (notably those built with cloud-init's config-drive support)
+// use the uppercase form.
+//https://docs.openstack.org/nova/latest/user/config-drive.html
+var configDriveLabels = []string{configDriveLabel, strings.ToUpper(configDriveLabel)}
+
+// findConfigDriveDevice locates the block device backing the config-drive.
+// /dev/disk/by-label is only populated while udev has processed the device,
+// which on immutable/CoreOS-style hosts may have already been torn down by
+// the bootstrapping agent (e.g. ignition) by the time this runs, so we fall
+// back to asking blkid directly and, if that's unavailable, walking
+// /sys/class/block ourselves.
+func findConfigDriveDevice() (string, error) {
+	for _, label := range configDriveLabels {
+		dev := "/dev/disk/by-label/" + label
+		if _, err := os.Stat(dev); err == nil {
+			return dev, nil
+		}
+	}
+
+	for _, label := range configDriveLabels {
 		out, err := exec.New().Command(
 			"blkid", "-l",
-			"-t", "LABEL="+configDriveLabel,
+			"-t", "LABEL="+label,
 			"-o", "device",
 		).CombinedOutput()
 		if err != nil {
-			return nil, fmt.Errorf("unable to run blkid: %v", err)
+			continue
+		}
+		if dev := strings.TrimSpace(string(out)); dev != "" {
+			return dev, nil
+		}
+	}
+
+	dev, err := findConfigDriveDeviceFromSysBlock()
+	if err != nil {
+		return "", fmt.Errorf("unable to locate config-drive device with label %s or %s: %v", configDriveLabels[0], configDriveLabels[1], err)
+	}
+	return dev, nil
+}
+
+// findConfigDriveDeviceFromSysBlock is a fallback for hosts where blkid is
+// unavailable (or has no cached udev database to query). It walks
+// /sys/class/block and asks udevadm, or failing that lsblk, for each
+// device's filesystem label.
+func findConfigDriveDeviceFromSysBlock() (string, error) {
+	entries, err := ioutil.ReadDir("/sys/class/block")
+	if err != nil {
+		return "", fmt.Errorf("unable to list /sys/class/block: %v", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		out, err := exec.New().Command(
+			"udevadm", "info",
+			"--query=property",
+			"--name="+name,
+		).CombinedOutput()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			label := strings.TrimPrefix(line, "ID_FS_LABEL=")
+			if label == line {
+				continue
+			}
+			for _, want := range configDriveLabels {
+				if label == want {
+					return "/dev/" + name, nil
+				}
+			}
+		}
+	}
+
+	return findConfigDriveDeviceFromLsblk()
+}
+
+// lsblkDevice and lsblkOutput mirror the subset of `lsblk -J` we care about.
+type lsblkDevice struct {
+	Name     string        `json:"name"`
+	Label    string        `json:"label"`
+	Children []lsblkDevice `json:"children,omitempty"`
+}
+
+type lsblkOutput struct {
+	BlockDevices []lsblkDevice `json:"blockdevices"`
+}
+
+// findConfigDriveDeviceFromLsblk is the last resort when neither udev's
+// by-label symlinks, blkid, nor udevadm are usable.
+func findConfigDriveDeviceFromLsblk() (string, error) {
+	out, err := exec.New().Command("lsblk", "-o", "NAME,LABEL", "-J").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("unable to run lsblk: %v", err)
+	}
+	return parseLsblkConfigDriveDevice(out)
+}
+
+// parseLsblkConfigDriveDevice walks the device tree from `lsblk -J` output
+// looking for a device labelled with any of configDriveLabels. Split out of
+// findConfigDriveDeviceFromLsblk so the JSON walk can be unit tested without
+// shelling out to lsblk.
+func parseLsblkConfigDriveDevice(out []byte) (string, error) {
+	var parsed lsblkOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return "", fmt.Errorf("unable to parse lsblk output: %v", err)
+	}
+
+	var walk func([]lsblkDevice) string
+	walk = func(devices []lsblkDevice) string {
+		for _, dev := range devices {
+			for _, want := range configDriveLabels {
+				if dev.Label == want {
+					return "/dev/" + dev.Name
+				}
+			}
+			if dev := walk(dev.Children); dev != "" {
+				return dev
+			}
 		}
-		dev = strings.TrimSpace(string(out))
+		return ""
+	}
+
+	if dev := walk(parsed.BlockDevices); dev != "" {
+		return dev, nil
+	}
+	return "", fmt.Errorf("no block device with label %s or %s found", configDriveLabels[0], configDriveLabels[1])
+}
+
+// mountConfigDrive locates and mounts the config drive read-only, returning
+// the directory it was mounted on and a cleanup func that unmounts it and
+// removes the mount directory. Callers must invoke the cleanup func (e.g.
+// via defer) on every return path, including panics.
+func mountConfigDrive() (string, func(), error) {
+	dev, err := findConfigDriveDevice()
+	if err != nil {
+		return "", nil, &transientMetadataError{fmt.Errorf("unable to locate config drive: %v", err)}
 	}
 
 	mntdir, err := ioutil.TempDir("", "configdrive")
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	defer os.Remove(mntdir)
 
 	glog.V(4).Infof("Attempting to mount configdrive %s on %s", dev, mntdir)
 
@@ -128,70 +440,358 @@ func getMetadataFromConfigDrive(metadataVersion string) (*Metadata, error) {
 		err = mounter.Mount(dev, mntdir, "vfat", []string{"ro"})
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error mounting configdrive %s: %v", dev, err)
+		os.Remove(mntdir)
+		return "", nil, &transientMetadataError{fmt.Errorf("error mounting configdrive %s: %v", dev, err)}
 	}
-	defer mounter.Unmount(mntdir)
 
 	glog.V(4).Infof("Configdrive mounted on %s", mntdir)
 
-	configDrivePath := getConfigDrivePath(metadataVersion)
+	cleanup := func() {
+		mounter.Unmount(mntdir)
+		os.Remove(mntdir)
+	}
+	return mntdir, cleanup, nil
+}
+
+// negotiateConfigDriveVersion picks the newest entry in supportedMetadataVersions
+// that's actually published under openstack/ on the mounted config drive,
+// unless opts pins a version. Falling back to defaultMetadataVersion (rather
+// than failing) keeps us working against older, pre-negotiation nova images.
+func negotiateConfigDriveVersion(mntdir string, opts MetadataOpts) string {
+	if opts.Version != "" {
+		return opts.Version
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(mntdir, metadataApiRootPath))
+	if err != nil {
+		glog.V(4).Infof("Unable to list published metadata versions on config drive, falling back to %s: %v", defaultMetadataVersion, err)
+		return defaultMetadataVersion
+	}
+
+	published := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			published[entry.Name()] = true
+		}
+	}
+	for _, version := range supportedMetadataVersions {
+		if published[version] {
+			return version
+		}
+	}
+	return defaultMetadataVersion
+}
+
+// negotiateMetadataServiceVersion is the metadata-service equivalent of
+// negotiateConfigDriveVersion: it lists rootUrl, which the metadata service
+// answers with one published version per line. Production callers always
+// pass metadataApiRootUrl; rootUrl is a parameter only so tests can point
+// this at an httptest.Server instead.
+//
+// This is a single best-effort request, not fetchURLWithRetry: the actual
+// meta_data.json/network_data.json fetch that follows already retries with
+// backoff, and running that same retry loop here too would make a down
+// metadata service pay for it twice before falling through to the next
+// search-order source.
+func negotiateMetadataServiceVersion(rootUrl string, opts MetadataOpts) string {
+	if opts.Version != "" {
+		return opts.Version
+	}
+
+	client := &http.Client{Timeout: opts.requestTimeout()}
+	resp, err := client.Get(rootUrl)
+	if err != nil {
+		glog.V(4).Infof("Unable to list published metadata versions from %s, falling back to %s: %v", rootUrl, defaultMetadataVersion, err)
+		return defaultMetadataVersion
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		glog.V(4).Infof("Unexpected status listing metadata versions from %s, falling back to %s: %s", rootUrl, defaultMetadataVersion, resp.Status)
+		return defaultMetadataVersion
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		glog.V(4).Infof("Unable to read metadata version listing from %s, falling back to %s: %v", rootUrl, defaultMetadataVersion, err)
+		return defaultMetadataVersion
+	}
+
+	published := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			published[line] = true
+		}
+	}
+	for _, version := range supportedMetadataVersions {
+		if published[version] {
+			return version
+		}
+	}
+	return defaultMetadataVersion
+}
+
+func getMetadataFromConfigDrive(opts MetadataOpts) (*Metadata, error) {
+	mntdir, cleanup, err := mountConfigDrive()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	configDrivePath := getConfigDrivePath(negotiateConfigDriveVersion(mntdir, opts))
 	f, err := os.Open(
 		filepath.Join(mntdir, configDrivePath))
 	if err != nil {
-		return nil, fmt.Errorf("error reading %s on config drive: %v", configDrivePath, err)
+		return nil, &transientMetadataError{fmt.Errorf("error reading %s on config drive: %v", configDrivePath, err)}
 	}
 	defer f.Close()
 
 	return parseMetadata(f)
 }
 
-func getMetadataFromMetadataService(metadataVersion string) (*Metadata, error) {
+// fetchURLWithRetry GETs url, retrying on transport errors and 5xx
+// responses with exponential backoff per opts. A response with any other
+// status code (including a successful 200) is returned as-is so the caller
+// can decide how to handle it; retries are exhausted without success return
+// a transientMetadataError, since those failures are about reachability,
+// not content.
+func fetchURLWithRetry(url string, opts MetadataOpts) (*http.Response, error) {
+	client := &http.Client{Timeout: opts.requestTimeout()}
+	backoff := opts.retryBackoffInitial()
+
+	var lastErr error
+	for attempt := 0; attempt <= opts.retryMax(); attempt++ {
+		if attempt > 0 {
+			glog.V(4).Infof("Retrying %s in %v (attempt %d/%d)", url, backoff, attempt, opts.retryMax())
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			lastErr = fmt.Errorf("error fetching %s: %v", url, err)
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("unexpected status code when reading %s: %s", url, resp.Status)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, &transientMetadataError{lastErr}
+}
+
+func getMetadataFromMetadataService(opts MetadataOpts) (*Metadata, error) {
 	// Try to get JSON from metadata server.
-	metadataUrl := getMetadataUrl(metadataVersion)
+	metadataUrl := getMetadataUrl(negotiateMetadataServiceVersion(metadataApiRootUrl, opts))
 	glog.V(4).Infof("Attempting to fetch metadata from %s", metadataUrl)
-	resp, err := http.Get(metadataUrl)
+	resp, err := fetchURLWithRetry(metadataUrl, opts)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching %s: %v", metadataUrl, err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("unexpected status code when reading metadata from %s: %s", metadataUrl, resp.Status)
-		return nil, err
+		return nil, fmt.Errorf("unexpected status code when reading metadata from %s: %s", metadataUrl, resp.Status)
 	}
 
 	return parseMetadata(resp.Body)
 }
 
+func getNetworkDataFromConfigDrive(opts MetadataOpts) (*NetworkData, error) {
+	mntdir, cleanup, err := mountConfigDrive()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	networkDataPath := getNetworkDataPath(negotiateConfigDriveVersion(mntdir, opts))
+	f, err := os.Open(
+		filepath.Join(mntdir, networkDataPath))
+	if err != nil {
+		return nil, &transientMetadataError{fmt.Errorf("error reading %s on config drive: %v", networkDataPath, err)}
+	}
+	defer f.Close()
+
+	return parseNetworkData(f)
+}
+
+func getNetworkDataFromMetadataService(opts MetadataOpts) (*NetworkData, error) {
+	networkDataUrl := getNetworkDataUrl(negotiateMetadataServiceVersion(metadataApiRootUrl, opts))
+	glog.V(4).Infof("Attempting to fetch network data from %s", networkDataUrl)
+	resp, err := fetchURLWithRetry(networkDataUrl, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code when reading network data from %s: %s", networkDataUrl, resp.Status)
+	}
+
+	return parseNetworkData(resp.Body)
+}
+
 // Metadata is fixed for the current host, so cache the value process-wide
-var metadataCache *Metadata
-
-func getMetadata(order string) (*Metadata, error) {
-	if metadataCache == nil {
-		var md *Metadata
-		var err error
-
-		elements := strings.Split(order, ",")
-		for _, id := range elements {
-			id = strings.TrimSpace(id)
-			switch id {
-			case configDriveID:
-				md, err = getMetadataFromConfigDrive(defaultMetadataVersion)
-			case metadataID:
-				md, err = getMetadataFromMetadataService(defaultMetadataVersion)
-			default:
-				err = fmt.Errorf("%s is not a valid metadata search order option. Supported options are %s and %s", id, configDriveID, metadataID)
-			}
+// once it's successfully fetched. metadataMu guards metadataCache so
+// concurrent callers can't race to populate it; a prior nil-check-and-set
+// here was a real data race when multiple goroutines called getMetadata
+// concurrently. Only a successful fetch is cached: the instance's
+// network/config-drive may not be up yet on the first call (e.g. during
+// provider Initialize), and caching that failure would make it permanent
+// for the life of the process instead of letting the next caller retry.
+var (
+	metadataMu    sync.Mutex
+	metadataCache *Metadata
+)
 
-			if err == nil {
-				break
-			}
+func getMetadata(opts MetadataOpts) (*Metadata, error) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+
+	if metadataCache != nil {
+		return metadataCache, nil
+	}
+
+	md, err := fetchMetadata(opts)
+	if err != nil {
+		return nil, err
+	}
+	metadataCache = md
+	return metadataCache, nil
+}
+
+func fetchMetadata(opts MetadataOpts) (*Metadata, error) {
+	var md *Metadata
+	var err error
+
+	elements := strings.Split(opts.searchOrder(), ",")
+	for _, id := range elements {
+		id = strings.TrimSpace(id)
+		switch id {
+		case configDriveID:
+			md, err = getMetadataFromConfigDrive(opts)
+		case metadataID:
+			md, err = getMetadataFromMetadataService(opts)
+		default:
+			err = fmt.Errorf("%s is not a valid metadata search order option. Supported options are %s and %s", id, configDriveID, metadataID)
 		}
 
-		if err != nil {
+		if err == nil {
+			break
+		}
+		if !isTransientMetadataError(err) {
 			return nil, err
 		}
-		metadataCache = md
 	}
-	return metadataCache, nil
+
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// networkData, like Metadata, is fixed for the current host and is cached
+// process-wide behind networkDataMu for the same reasons as metadataMu:
+// race-free population, and only success is cached so a transient failure
+// doesn't stick around for the life of the process.
+var (
+	networkDataMu    sync.Mutex
+	networkDataCache *NetworkData
+)
+
+func getNetworkData(opts MetadataOpts) (*NetworkData, error) {
+	networkDataMu.Lock()
+	defer networkDataMu.Unlock()
+
+	if networkDataCache != nil {
+		return networkDataCache, nil
+	}
+
+	nd, err := fetchNetworkData(opts)
+	if err != nil {
+		return nil, err
+	}
+	networkDataCache = nd
+	return networkDataCache, nil
+}
+
+func fetchNetworkData(opts MetadataOpts) (*NetworkData, error) {
+	var nd *NetworkData
+	var err error
+
+	elements := strings.Split(opts.searchOrder(), ",")
+	for _, id := range elements {
+		id = strings.TrimSpace(id)
+		switch id {
+		case configDriveID:
+			nd, err = getNetworkDataFromConfigDrive(opts)
+		case metadataID:
+			nd, err = getNetworkDataFromMetadataService(opts)
+		default:
+			err = fmt.Errorf("%s is not a valid metadata search order option. Supported options are %s and %s", id, configDriveID, metadataID)
+		}
+
+		if err == nil {
+			break
+		}
+		if !isTransientMetadataError(err) {
+			return nil, err
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// GetNetworkData returns the network_data.json published by OpenStack for
+// this instance, discovered via the same config-drive/metadata-service
+// search order as instance metadata. Consumers such as SR-IOV device
+// plugins and CNI plumbing use the link-to-PCI-address mapping it carries
+// to bind Kubernetes network attachments to the correct VF on the instance.
+func GetNetworkData(opts MetadataOpts) (*NetworkData, error) {
+	return getNetworkData(opts)
+}
+
+// InstanceID returns the instance's UUID, lazily fetched from the configured
+// metadata source and cached process-wide.
+func InstanceID(opts MetadataOpts) (string, error) {
+	md, err := getMetadata(opts)
+	if err != nil {
+		return "", err
+	}
+	return md.Uuid, nil
+}
+
+// AvailabilityZone returns the instance's availability zone, lazily fetched
+// from the configured metadata source and cached process-wide.
+func AvailabilityZone(opts MetadataOpts) (string, error) {
+	md, err := getMetadata(opts)
+	if err != nil {
+		return "", err
+	}
+	return md.AvailabilityZone, nil
+}
+
+// Hostname returns the instance's hostname, lazily fetched from the
+// configured metadata source and cached process-wide.
+func Hostname(opts MetadataOpts) (string, error) {
+	md, err := getMetadata(opts)
+	if err != nil {
+		return "", err
+	}
+	return md.Hostname, nil
+}
+
+// Devices returns the instance's device metadata, lazily fetched from the
+// configured metadata source and cached process-wide.
+func Devices(opts MetadataOpts) ([]DeviceMetadata, error) {
+	md, err := getMetadata(opts)
+	if err != nil {
+		return nil, err
+	}
+	return md.Devices, nil
 }
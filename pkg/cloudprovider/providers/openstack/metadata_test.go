@@ -0,0 +1,363 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseLsblkConfigDriveDevice(t *testing.T) {
+	testcases := []struct {
+		name    string
+		out     string
+		wantDev string
+		wantErr bool
+	}{
+		{
+			name:    "top-level match",
+			out:     `{"blockdevices": [{"name": "vda", "label": null}, {"name": "sr0", "label": "config-2"}]}`,
+			wantDev: "/dev/sr0",
+		},
+		{
+			name:    "uppercase label matches too",
+			out:     `{"blockdevices": [{"name": "vdb", "label": "CONFIG-2"}]}`,
+			wantDev: "/dev/vdb",
+		},
+		{
+			name:    "match nested under a parent device's children",
+			out:     `{"blockdevices": [{"name": "vda", "label": null, "children": [{"name": "vda1", "label": "config-2"}]}]}`,
+			wantDev: "/dev/vda1",
+		},
+		{
+			name:    "no matching label",
+			out:     `{"blockdevices": [{"name": "vda", "label": null}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed json",
+			out:     `not json`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dev, err := parseLsblkConfigDriveDevice([]byte(tc.out))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got device %q", dev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dev != tc.wantDev {
+				t.Errorf("got device %q, want %q", dev, tc.wantDev)
+			}
+		})
+	}
+}
+
+func TestParseNetworkData(t *testing.T) {
+	const networkData = `{
+		"links": [
+			{"id": "tap1", "vif_id": "abc123", "type": "ovs", "mtu": 1500, "ethernet_mac_address": "fa:16:3e:aa:bb:cc"}
+		],
+		"networks": [
+			{"id": "net1", "type": "ipv4", "link": "tap1", "network_id": "netid1", "ip_address": "10.0.0.5", "netmask": "255.255.255.0",
+			 "routes": [{"network": "0.0.0.0", "netmask": "0.0.0.0", "gateway": "10.0.0.1"}]}
+		],
+		"services": [
+			{"type": "dns", "address": "8.8.8.8"}
+		]
+	}`
+
+	nd, err := parseNetworkData(strings.NewReader(networkData))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(nd.Links) != 1 || nd.Links[0].EthernetMacAddress != "fa:16:3e:aa:bb:cc" {
+		t.Errorf("unexpected links: %+v", nd.Links)
+	}
+	if len(nd.Networks) != 1 || nd.Networks[0].IPAddress != "10.0.0.5" || len(nd.Networks[0].Routes) != 1 {
+		t.Errorf("unexpected networks: %+v", nd.Networks)
+	}
+	if len(nd.Services) != 1 || nd.Services[0].Address != "8.8.8.8" {
+		t.Errorf("unexpected services: %+v", nd.Services)
+	}
+}
+
+func TestParseNetworkDataMalformed(t *testing.T) {
+	if _, err := parseNetworkData(strings.NewReader("not json")); err == nil {
+		t.Fatal("expected an error parsing malformed network_data.json")
+	}
+}
+
+// fastRetryOpts keeps retry tests from actually waiting out the exponential
+// backoff.
+var fastRetryOpts = MetadataOpts{RetryMax: 2, RetryBackoffInitialMilliseconds: 1}
+
+func TestFetchURLWithRetrySucceedsImmediately(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	resp, err := fetchURLWithRetry(server.URL, fastRetryOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, want 1", got)
+	}
+}
+
+func TestFetchURLWithRetryRetriesOn5xxThenSucceeds(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	resp, err := fetchURLWithRetry(server.URL, fastRetryOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("got %d calls, want 3", got)
+	}
+}
+
+func TestFetchURLWithRetryExhaustsRetriesOnPersistent5xx(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := fetchURLWithRetry(server.URL, fastRetryOpts)
+	if err == nil {
+		t.Fatal("expected an error after exhausting retries")
+	}
+	if !isTransientMetadataError(err) {
+		t.Errorf("expected a transientMetadataError, got %T: %v", err, err)
+	}
+	if want := fastRetryOpts.retryMax() + 1; int(atomic.LoadInt32(&calls)) != want {
+		t.Errorf("got %d calls, want %d", calls, want)
+	}
+}
+
+func TestFetchURLWithRetryDoesNotRetryOnNon5xxStatus(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	resp, err := fetchURLWithRetry(server.URL, fastRetryOpts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, want 1 (non-5xx statuses should not be retried)", got)
+	}
+}
+
+func TestGetMetadataDoesNotCacheFailure(t *testing.T) {
+	orig := metadataCache
+	defer func() { metadataCache = orig }()
+	metadataCache = nil
+
+	badOpts := MetadataOpts{SearchOrder: "not-a-valid-source"}
+	if _, err := getMetadata(badOpts); err == nil {
+		t.Fatal("expected an error for an invalid search order")
+	}
+	if metadataCache != nil {
+		t.Fatal("a failed fetch must not populate metadataCache, or every later caller is stuck with the same stale error")
+	}
+
+	// A later call must retry rather than replay a cached failure forever.
+	if _, err := getMetadata(badOpts); err == nil {
+		t.Fatal("expected the retry to fail the same way, not succeed silently")
+	}
+}
+
+func TestGetMetadataReturnsCachedValueWithoutRefetching(t *testing.T) {
+	orig := metadataCache
+	defer func() { metadataCache = orig }()
+	metadataCache = &Metadata{Uuid: "cached-uuid"}
+
+	// An invalid search order would error out if getMetadata actually tried
+	// to fetch; getting the cached value back instead proves the cache is
+	// consulted before any source is contacted.
+	md, err := getMetadata(MetadataOpts{SearchOrder: "not-a-valid-source"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if md.Uuid != "cached-uuid" {
+		t.Errorf("got uuid %q, want %q", md.Uuid, "cached-uuid")
+	}
+}
+
+func TestGetNetworkDataDoesNotCacheFailure(t *testing.T) {
+	orig := networkDataCache
+	defer func() { networkDataCache = orig }()
+	networkDataCache = nil
+
+	badOpts := MetadataOpts{SearchOrder: "not-a-valid-source"}
+	if _, err := getNetworkData(badOpts); err == nil {
+		t.Fatal("expected an error for an invalid search order")
+	}
+	if networkDataCache != nil {
+		t.Fatal("a failed fetch must not populate networkDataCache, or every later caller is stuck with the same stale error")
+	}
+	if _, err := getNetworkData(badOpts); err == nil {
+		t.Fatal("expected the retry to fail the same way, not succeed silently")
+	}
+}
+
+func TestNegotiateConfigDriveVersion(t *testing.T) {
+	mkdir := func(t *testing.T, versions ...string) string {
+		dir, err := ioutil.TempDir("", "configdrive")
+		if err != nil {
+			t.Fatalf("unable to create temp dir: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		for _, version := range versions {
+			if err := os.MkdirAll(filepath.Join(dir, metadataApiRootPath, version), 0755); err != nil {
+				t.Fatalf("unable to create version dir: %v", err)
+			}
+		}
+		return dir
+	}
+
+	t.Run("picks the newest published version", func(t *testing.T) {
+		dir := mkdir(t, "2012-08-10", "2016-10-06", "2013-10-17")
+		if got, want := negotiateConfigDriveVersion(dir, MetadataOpts{}), "2016-10-06"; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("pinned version is used without consulting the config drive", func(t *testing.T) {
+		dir := mkdir(t, "2012-08-10")
+		opts := MetadataOpts{Version: "2099-01-01"}
+		if got, want := negotiateConfigDriveVersion(dir, opts), "2099-01-01"; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("falls back to the default when nothing is published", func(t *testing.T) {
+		dir := mkdir(t)
+		if err := os.MkdirAll(filepath.Join(dir, metadataApiRootPath), 0755); err != nil {
+			t.Fatalf("unable to create %s dir: %v", metadataApiRootPath, err)
+		}
+		if got, want := negotiateConfigDriveVersion(dir, MetadataOpts{}), defaultMetadataVersion; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("falls back to the default when the openstack dir is missing", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "configdrive")
+		if err != nil {
+			t.Fatalf("unable to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		if got, want := negotiateConfigDriveVersion(dir, MetadataOpts{}), defaultMetadataVersion; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+}
+
+func TestNegotiateMetadataServiceVersion(t *testing.T) {
+	serve := func(t *testing.T, body string, status int) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+
+	t.Run("picks the newest published version", func(t *testing.T) {
+		url := serve(t, "2012-08-10\n2016-10-06\n2013-10-17\n", http.StatusOK)
+		if got, want := negotiateMetadataServiceVersion(url, MetadataOpts{}), "2016-10-06"; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("pinned version is used without making a request", func(t *testing.T) {
+		opts := MetadataOpts{Version: "2099-01-01"}
+		if got, want := negotiateMetadataServiceVersion("http://127.0.0.1:0/unreachable", opts), "2099-01-01"; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("falls back to the default on non-200 status", func(t *testing.T) {
+		url := serve(t, "", http.StatusServiceUnavailable)
+		if got, want := negotiateMetadataServiceVersion(url, MetadataOpts{}), defaultMetadataVersion; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("falls back to the default when nothing published is supported", func(t *testing.T) {
+		url := serve(t, "2099-01-01\n", http.StatusOK)
+		if got, want := negotiateMetadataServiceVersion(url, MetadataOpts{}), defaultMetadataVersion; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+
+	t.Run("falls back to the default when the service is unreachable", func(t *testing.T) {
+		if got, want := negotiateMetadataServiceVersion("http://127.0.0.1:0/unreachable", MetadataOpts{}), defaultMetadataVersion; got != want {
+			t.Errorf("got version %q, want %q", got, want)
+		}
+	})
+}
+
+func TestMetadataOptsSearchOrderDefault(t *testing.T) {
+	var opts MetadataOpts
+	if got := opts.searchOrder(); got != defaultMetadataSearchOrder {
+		t.Errorf("got default search order %q, want %q", got, defaultMetadataSearchOrder)
+	}
+
+	opts.SearchOrder = metadataID
+	if got := opts.searchOrder(); got != metadataID {
+		t.Errorf("got search order %q, want %q", got, metadataID)
+	}
+}